@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// queryer is the subset of *sql.DB used by logStore, so tests can supply a
+// fake store instead of hitting MySQL.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// StoredRecord is a row read back from the request table by logStore.
+type StoredRecord struct {
+	ID            int64               `json:"id"`
+	ReceivedAt    time.Time           `json:"received_at"`
+	URL           string              `json:"url"`
+	Method        string              `json:"method"`
+	Remote        string              `json:"remote"`
+	Headers       map[string][]string `json:"headers"`
+	Length        int                 `json:"length"`
+	Protocol      string              `json:"protocol"`
+	ClientCN      string              `json:"client_cn,omitempty"`
+	ClientSAN     []string            `json:"client_san,omitempty"`
+	BodyTruncated bool                `json:"body_truncated"`
+	BodySHA256    string              `json:"body_sha256,omitempty"`
+
+	// Body is only populated by logStore.get, never by list: returning it
+	// for every row in a page would make GET /logs arbitrarily expensive.
+	// scanStoredRecordWithBody decompresses it if it was stored gzipped, so
+	// it always holds the captured bytes as received.
+	Body []byte `json:"body,omitempty"`
+}
+
+const (
+	defaultLogsLimit = 100
+	maxLogsLimit     = 1000
+)
+
+// logFilter describes a GET /logs query.
+type logFilter struct {
+	Method    string
+	Remote    string
+	URLLike   string
+	Protocol  string
+	Since     time.Time
+	Until     time.Time
+	MinLength int
+	Limit     int
+	Cursor    string
+}
+
+func logFilterFromQuery(q url.Values) (logFilter, error) {
+	f := logFilter{
+		Method:   q.Get("method"),
+		Remote:   q.Get("remote"),
+		URLLike:  q.Get("url_like"),
+		Protocol: q.Get("protocol"),
+		Cursor:   q.Get("cursor"),
+		Limit:    defaultLogsLimit,
+	}
+	if v := q.Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return f, fmt.Errorf("since: %v", err)
+		}
+		f.Since = t
+	}
+	if v := q.Get("until"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return f, fmt.Errorf("until: %v", err)
+		}
+		f.Until = t
+	}
+	if v := q.Get("min_length"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return f, fmt.Errorf("min_length: %v", err)
+		}
+		f.MinLength = n
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return f, fmt.Errorf("limit: %v", err)
+		}
+		f.Limit = n
+	}
+	if f.Limit <= 0 || f.Limit > maxLogsLimit {
+		f.Limit = defaultLogsLimit
+	}
+	return f, nil
+}
+
+// logCursor is the keyset pagination cursor: the (rat, id) of the last row
+// of the previous page.
+type logCursor struct {
+	RAT time.Time `json:"rat"`
+	ID  int64     `json:"id"`
+}
+
+func encodeLogCursor(c logCursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeLogCursor(s string) (logCursor, error) {
+	var c logCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(b, &c)
+	return c, err
+}
+
+// recordStore is implemented by logStore and lets tests substitute a fake
+// store instead of a real database.
+type recordStore interface {
+	list(ctx context.Context, f logFilter) (records []*StoredRecord, nextCursor string, err error)
+	get(ctx context.Context, id int64) (*StoredRecord, error)
+}
+
+// logStore reads back request records stored by mysqlSink.
+type logStore struct {
+	q queryer
+}
+
+func newLogStore(q queryer) *logStore {
+	return &logStore{q: q}
+}
+
+func (s *logStore) list(ctx context.Context, f logFilter) (records []*StoredRecord, nextCursor string, err error) {
+	query := `select id, rat, url, method, remote, headers, length, protocol, client_cn, client_san, body_truncated, body_sha256
+		from request where 1=1`
+	var args []interface{}
+
+	if f.Method != "" {
+		query += " and method = ?"
+		args = append(args, f.Method)
+	}
+	if f.Remote != "" {
+		query += " and remote = ?"
+		args = append(args, f.Remote)
+	}
+	if f.URLLike != "" {
+		query += " and url like ?"
+		args = append(args, "%"+f.URLLike+"%")
+	}
+	if f.Protocol != "" {
+		query += " and protocol = ?"
+		args = append(args, f.Protocol)
+	}
+	if !f.Since.IsZero() {
+		query += " and rat >= ?"
+		args = append(args, f.Since)
+	}
+	if !f.Until.IsZero() {
+		query += " and rat <= ?"
+		args = append(args, f.Until)
+	}
+	if f.MinLength > 0 {
+		query += " and length >= ?"
+		args = append(args, f.MinLength)
+	}
+	if f.Cursor != "" {
+		c, err := decodeLogCursor(f.Cursor)
+		if err != nil {
+			return nil, "", fmt.Errorf("cursor: %v", err)
+		}
+		query += " and (rat, id) > (?, ?)"
+		args = append(args, c.RAT, c.ID)
+	}
+	query += " order by rat, id limit ?"
+	args = append(args, f.Limit)
+
+	rows, err := s.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("logStore list: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		r, err := scanStoredRecord(rows)
+		if err != nil {
+			return nil, "", fmt.Errorf("logStore list: %v", err)
+		}
+		records = append(records, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("logStore list: %v", err)
+	}
+
+	if len(records) == f.Limit {
+		last := records[len(records)-1]
+		nextCursor = encodeLogCursor(logCursor{RAT: last.ReceivedAt, ID: last.ID})
+	}
+	return records, nextCursor, nil
+}
+
+func (s *logStore) get(ctx context.Context, id int64) (*StoredRecord, error) {
+	rows, err := s.q.QueryContext(ctx,
+		`select id, rat, url, method, remote, headers, length, protocol, client_cn, client_san, body, body_truncated, body_sha256, body_gzipped
+		from request where id = ?`, id)
+	if err != nil {
+		return nil, fmt.Errorf("logStore get: %v", err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, nil
+	}
+	r, err := scanStoredRecordWithBody(rows)
+	if err != nil {
+		return nil, fmt.Errorf("logStore get: %v", err)
+	}
+	return r, nil
+}
+
+func scanStoredRecord(rows *sql.Rows) (*StoredRecord, error) {
+	var r StoredRecord
+	var headers string
+	var clientCN, clientSAN, bodySHA256 sql.NullString
+	if err := rows.Scan(&r.ID, &r.ReceivedAt, &r.URL, &r.Method, &r.Remote, &headers,
+		&r.Length, &r.Protocol, &clientCN, &clientSAN, &r.BodyTruncated, &bodySHA256); err != nil {
+		return nil, err
+	}
+	r.ClientCN = clientCN.String
+	r.BodySHA256 = bodySHA256.String
+	if clientSAN.Valid && clientSAN.String != "" {
+		if err := json.Unmarshal([]byte(clientSAN.String), &r.ClientSAN); err != nil {
+			return nil, err
+		}
+	}
+	if headers != "" {
+		if err := json.Unmarshal([]byte(headers), &r.Headers); err != nil {
+			return nil, err
+		}
+	}
+	return &r, nil
+}
+
+// scanStoredRecordWithBody is like scanStoredRecord but also scans the body
+// and body_gzipped columns, decompressing Body when it was stored gzipped.
+// It's only used by logStore.get: returning the body for every row of a
+// list page would make GET /logs arbitrarily expensive.
+func scanStoredRecordWithBody(rows *sql.Rows) (*StoredRecord, error) {
+	var r StoredRecord
+	var headers string
+	var clientCN, clientSAN, bodySHA256 sql.NullString
+	var bodyGzipped bool
+	if err := rows.Scan(&r.ID, &r.ReceivedAt, &r.URL, &r.Method, &r.Remote, &headers,
+		&r.Length, &r.Protocol, &clientCN, &clientSAN, &r.Body, &r.BodyTruncated, &bodySHA256, &bodyGzipped); err != nil {
+		return nil, err
+	}
+	r.ClientCN = clientCN.String
+	r.BodySHA256 = bodySHA256.String
+	if clientSAN.Valid && clientSAN.String != "" {
+		if err := json.Unmarshal([]byte(clientSAN.String), &r.ClientSAN); err != nil {
+			return nil, err
+		}
+	}
+	if headers != "" {
+		if err := json.Unmarshal([]byte(headers), &r.Headers); err != nil {
+			return nil, err
+		}
+	}
+	if bodyGzipped && len(r.Body) > 0 {
+		b, err := gunzipBytes(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		r.Body = b
+	}
+	return &r, nil
+}
+
+// broadcastHub fans newly written RequestRecords out to subscribers, so
+// GET /logs/stream can tail inserts as they happen.
+type broadcastHub struct {
+	mu   sync.Mutex
+	subs map[chan *RequestRecord]struct{}
+}
+
+func newBroadcastHub() *broadcastHub {
+	return &broadcastHub{subs: make(map[chan *RequestRecord]struct{})}
+}
+
+func (h *broadcastHub) subscribe() (ch chan *RequestRecord, unsubscribe func()) {
+	ch = make(chan *RequestRecord, 16)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs, ch)
+		h.mu.Unlock()
+		close(ch)
+	}
+}
+
+func (h *broadcastHub) broadcast(rec *RequestRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- rec:
+		default:
+			log.Printf("broadcastHub: subscriber queue full, dropping record")
+		}
+	}
+}
+
+func (s *server) serveLogsList(w http.ResponseWriter, r *http.Request) {
+	f, err := logFilterFromQuery(r.URL.Query())
+	if err != nil {
+		jsonError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	records, next, err := s.logs.list(r.Context(), f)
+	if err != nil {
+		log.Printf("serveLogsList: %v", err)
+		jsonError(w, fmt.Sprintf("internal error: %v", err), 500)
+		return
+	}
+	json.NewEncoder(w).Encode(struct {
+		Records []*StoredRecord `json:"records"`
+		Cursor  string          `json:"cursor,omitempty"`
+	}{records, next})
+}
+
+func (s *server) serveLogsGet(w http.ResponseWriter, r *http.Request) {
+	idStr := strings.TrimPrefix(r.URL.Path, "/logs/")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		jsonError(w, fmt.Sprintf("invalid id %q", idStr), http.StatusBadRequest)
+		return
+	}
+	rec, err := s.logs.get(r.Context(), id)
+	if err != nil {
+		log.Printf("serveLogsGet: %v", err)
+		jsonError(w, fmt.Sprintf("internal error: %v", err), 500)
+		return
+	}
+	if rec == nil {
+		jsonError(w, "not found", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(rec)
+}
+
+func (s *server) serveLogsStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		jsonError(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	ch, unsubscribe := s.hub.subscribe()
+	defer unsubscribe()
+
+	for {
+		select {
+		case rec := <-ch:
+			b, err := json.Marshal(rec)
+			if err != nil {
+				log.Printf("serveLogsStream: %v", err)
+				continue
+			}
+			fmt.Fprintf(w, "data: %s\n\n", b)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
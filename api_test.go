@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeRecordStore is a recordStore backed by an in-memory slice, so api.go's
+// handlers can be tested without a database.
+type fakeRecordStore struct {
+	records []*StoredRecord
+}
+
+func (f *fakeRecordStore) list(ctx context.Context, filt logFilter) ([]*StoredRecord, string, error) {
+	var out []*StoredRecord
+	for _, r := range f.records {
+		if filt.Cursor != "" {
+			c, err := decodeLogCursor(filt.Cursor)
+			if err != nil {
+				return nil, "", err
+			}
+			if !r.ReceivedAt.After(c.RAT) && r.ID <= c.ID {
+				continue
+			}
+		}
+		out = append(out, r)
+	}
+	limit := filt.Limit
+	if limit <= 0 || limit > len(out) {
+		limit = len(out)
+	}
+	page := out[:limit]
+	var next string
+	if len(page) == filt.Limit && len(page) > 0 {
+		last := page[len(page)-1]
+		next = encodeLogCursor(logCursor{RAT: last.ReceivedAt, ID: last.ID})
+	}
+	return page, next, nil
+}
+
+func (f *fakeRecordStore) get(ctx context.Context, id int64) (*StoredRecord, error) {
+	for _, r := range f.records {
+		if r.ID == id {
+			return r, nil
+		}
+	}
+	return nil, nil
+}
+
+func TestLogCursorRoundTrip(t *testing.T) {
+	c := logCursor{RAT: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC), ID: 42}
+	got, err := decodeLogCursor(encodeLogCursor(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.RAT.Equal(c.RAT) || got.ID != c.ID {
+		t.Errorf("got %+v, want %+v", got, c)
+	}
+}
+
+func TestServeLogsGet(t *testing.T) {
+	store := &fakeRecordStore{records: []*StoredRecord{
+		{ID: 1, URL: "http://example.com/a"},
+	}}
+	s := &server{logs: store}
+	ts := httptest.NewServer(http.HandlerFunc(s.serveLogsGet))
+	defer ts.Close()
+
+	tests := map[string]struct {
+		path     string
+		wantCode int
+	}{
+		"found":     {"/logs/1", 200},
+		"not found": {"/logs/2", 404},
+		"bad id":    {"/logs/abc", 400},
+	}
+	for name, test := range tests {
+		res, err := http.Get(ts.URL + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != test.wantCode {
+			t.Errorf("%q: want status %d, got %d", name, test.wantCode, res.StatusCode)
+		}
+	}
+}
+
+func TestServeLogsListPagination(t *testing.T) {
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := &fakeRecordStore{}
+	for i := int64(1); i <= 3; i++ {
+		store.records = append(store.records, &StoredRecord{ID: i, ReceivedAt: base.Add(time.Duration(i) * time.Second)})
+	}
+	s := &server{logs: store}
+	ts := httptest.NewServer(http.HandlerFunc(s.serveLogsList))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/logs?limit=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var page struct {
+		Records []*StoredRecord `json:"records"`
+		Cursor  string          `json:"cursor,omitempty"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Records) != 2 || page.Cursor == "" {
+		t.Fatalf("got %+v, want 2 records with a cursor", page)
+	}
+
+	res2, err := http.Get(ts.URL + "/logs?limit=2&cursor=" + page.Cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var page2 struct {
+		Records []*StoredRecord `json:"records"`
+		Cursor  string          `json:"cursor,omitempty"`
+	}
+	if err := json.NewDecoder(res2.Body).Decode(&page2); err != nil {
+		t.Fatal(err)
+	}
+	if len(page2.Records) != 1 || page2.Cursor != "" {
+		t.Fatalf("got %+v, want 1 record with no cursor", page2)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const defaultBodyGzipThreshold = 1 << 10 // 1KiB
+
+// bodyCaptureConfig controls whether serveReqLog captures request bodies
+// and, if so, how much of each it keeps.
+type bodyCaptureConfig struct {
+	maxBytes      int64
+	allowedTypes  []string
+	gzipThreshold int64
+}
+
+// bodyCaptureConfigFromEnv reads REQLOGD_CAPTURE_BODY_MAX_BYTES,
+// REQLOGD_CAPTURE_BODY_TYPES, and REQLOGD_CAPTURE_BODY_GZIP_THRESHOLD. Body
+// capture stays off (the zero value) unless REQLOGD_CAPTURE_BODY_MAX_BYTES
+// is set.
+func bodyCaptureConfigFromEnv() (bodyCaptureConfig, error) {
+	var conf bodyCaptureConfig
+	conf.gzipThreshold = defaultBodyGzipThreshold
+
+	v, ok := os.LookupEnv("REQLOGD_CAPTURE_BODY_MAX_BYTES")
+	if !ok {
+		return conf, nil
+	}
+	maxBytes, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return conf, fmt.Errorf("REQLOGD_CAPTURE_BODY_MAX_BYTES: %v", err)
+	}
+	conf.maxBytes = maxBytes
+
+	if v, ok := os.LookupEnv("REQLOGD_CAPTURE_BODY_TYPES"); ok {
+		for _, t := range strings.Split(v, ",") {
+			conf.allowedTypes = append(conf.allowedTypes, strings.TrimSpace(t))
+		}
+	}
+	if v, ok := os.LookupEnv("REQLOGD_CAPTURE_BODY_GZIP_THRESHOLD"); ok {
+		threshold, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return conf, fmt.Errorf("REQLOGD_CAPTURE_BODY_GZIP_THRESHOLD: %v", err)
+		}
+		conf.gzipThreshold = threshold
+	}
+	return conf, nil
+}
+
+func (c bodyCaptureConfig) enabled() bool {
+	return c.maxBytes > 0
+}
+
+// allows reports whether contentType is eligible for capture. An empty
+// allow-list means every content type is eligible.
+func (c bodyCaptureConfig) allows(contentType string) bool {
+	if len(c.allowedTypes) == 0 {
+		return true
+	}
+	for _, prefix := range c.allowedTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// readCapturedBody reads up to maxBytes of body for storage while still
+// draining and counting the rest, so the reported total length matches the
+// full request body even when the capture itself is truncated.
+func readCapturedBody(body io.Reader, maxBytes int64) (captured []byte, truncated bool, total int, err error) {
+	b, err := ioutil.ReadAll(io.LimitReader(body, maxBytes+1))
+	if err != nil {
+		return nil, false, 0, err
+	}
+	total = len(b)
+	if int64(len(b)) > maxBytes {
+		b = b[:maxBytes]
+		truncated = true
+	}
+	n, err := io.Copy(ioutil.Discard, body)
+	total += int(n)
+	if err != nil {
+		return b, truncated, total, err
+	}
+	return b, truncated, total, nil
+}
+
+// gzipBytes compresses b with gzip's default compression level.
+func gzipBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// gunzipBytes decompresses b, the inverse of gzipBytes.
+func gunzipBytes(b []byte) ([]byte, error) {
+	gr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+	return ioutil.ReadAll(gr)
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
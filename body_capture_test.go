@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBodyCaptureConfigAllows(t *testing.T) {
+	conf := bodyCaptureConfig{allowedTypes: []string{"application/json", "text/"}}
+	tests := map[string]struct {
+		contentType string
+		want        bool
+	}{
+		"json allowed":      {"application/json", true},
+		"json with charset": {"application/json; charset=utf-8", true},
+		"text prefix":       {"text/plain", true},
+		"binary rejected":   {"application/octet-stream", false},
+	}
+	for name, test := range tests {
+		if got := conf.allows(test.contentType); got != test.want {
+			t.Errorf("%q: allows(%q) = %v, want %v", name, test.contentType, got, test.want)
+		}
+	}
+}
+
+func TestBodyCaptureConfigAllowsEmptyAllowList(t *testing.T) {
+	var conf bodyCaptureConfig
+	if !conf.allows("anything/at-all") {
+		t.Error("empty allow-list should allow every content type")
+	}
+}
+
+func TestReadCapturedBodyTruncates(t *testing.T) {
+	body := strings.NewReader("0123456789")
+	captured, truncated, total, err := readCapturedBody(body, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !truncated {
+		t.Error("want truncated = true")
+	}
+	if string(captured) != "0123" {
+		t.Errorf("got captured %q, want %q", captured, "0123")
+	}
+	if total != 10 {
+		t.Errorf("got total %d, want 10", total)
+	}
+}
+
+func TestGzipBytesRoundTrip(t *testing.T) {
+	want := "the quick brown fox jumps over the lazy dog"
+	gz, err := gzipBytes([]byte(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := gunzipBytes(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestReadCapturedBodyUnderLimit(t *testing.T) {
+	body := strings.NewReader("short")
+	captured, truncated, total, err := readCapturedBody(body, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if truncated {
+		t.Error("want truncated = false")
+	}
+	if string(captured) != "short" {
+		t.Errorf("got captured %q, want %q", captured, "short")
+	}
+	if total != 5 {
+		t.Errorf("got total %d, want 5", total)
+	}
+}
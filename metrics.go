@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	intakeTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "reqlogd_intake_total",
+		Help: "Total number of incoming requests logged.",
+	})
+	sinkWriteDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "reqlogd_sink_write_duration_seconds",
+		Help:    "Latency of writing a request record, or a batch of them, to a sink.",
+		Buckets: []float64{.001, .005, .01, .05, .1, .5, 1, 5},
+	})
+	sinkWriteErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "reqlogd_sink_write_errors_total",
+		Help: "Total number of sink write errors, by class.",
+	}, []string{"class"})
+	bodyCaptureBytesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "reqlogd_body_capture_bytes_total",
+		Help: "Total number of request body bytes captured.",
+	})
+	sinkQueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "reqlogd_sink_queue_depth",
+		Help: "Current number of records queued for async sink delivery.",
+	}, []string{"sink"})
+)
+
+// errClass buckets an error into a small, fixed set of labels so
+// sinkWriteErrorsTotal doesn't grow an unbounded cardinality of error
+// strings.
+func errClass(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, errSinkQueueFull):
+		return "queue_full"
+	default:
+		return "other"
+	}
+}
+
+// queueStatter is implemented by sinks that can report how full their
+// internal delivery queue is, for /readyz.
+type queueStatter interface {
+	queueStats() (depth, capacity int)
+}
+
+// sinkQueueFull reports whether any sink reachable from sink has a full
+// delivery queue, walking into MultiSink.
+func sinkQueueFull(sink Sink) (full bool, name string) {
+	switch s := sink.(type) {
+	case queueStatter:
+		depth, capacity := s.queueStats()
+		if capacity > 0 && depth >= capacity {
+			return true, fmt.Sprintf("%T", sink)
+		}
+	case MultiSink:
+		for _, sub := range s {
+			if full, name := sinkQueueFull(sub); full {
+				return true, name
+			}
+		}
+	}
+	return false, ""
+}
+
+func (s *server) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
+
+// serveReadyz reports ready only once the DB is reachable and no sink's
+// delivery queue is full, so a load balancer or Kubernetes can hold traffic
+// back until reqlogd can actually make progress.
+func (s *server) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	if s.pinger != nil {
+		if err := s.pinger.PingContext(ctx); err != nil {
+			jsonError(w, fmt.Sprintf("db unreachable: %v", err), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	if full, name := sinkQueueFull(s.sink); full {
+		jsonError(w, fmt.Sprintf("sink %q queue is full", name), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type fakePinger struct {
+	err error
+}
+
+func (f fakePinger) PingContext(ctx context.Context) error { return f.err }
+
+// fakeQueueStatter is a Sink whose reported queue depth/capacity are fixed,
+// so serveReadyz's "is any sink's queue full" check can be tested without a
+// real asyncSink.
+type fakeQueueStatter struct {
+	depth, capacity int
+}
+
+func (f fakeQueueStatter) Write(ctx context.Context, r *RequestRecord) error { return nil }
+func (f fakeQueueStatter) Close() error                                     { return nil }
+func (f fakeQueueStatter) queueStats() (depth, capacity int)                { return f.depth, f.capacity }
+
+func TestServeReadyz(t *testing.T) {
+	tests := map[string]struct {
+		pinger interface {
+			PingContext(ctx context.Context) error
+		}
+		sink     Sink
+		wantCode int
+	}{
+		"db and sink healthy": {
+			pinger:   fakePinger{},
+			sink:     fakeQueueStatter{depth: 0, capacity: 10},
+			wantCode: http.StatusOK,
+		},
+		"db unreachable": {
+			pinger:   fakePinger{err: errors.New("boom")},
+			sink:     fakeQueueStatter{depth: 0, capacity: 10},
+			wantCode: http.StatusServiceUnavailable,
+		},
+		"sink queue full": {
+			pinger:   fakePinger{},
+			sink:     fakeQueueStatter{depth: 10, capacity: 10},
+			wantCode: http.StatusServiceUnavailable,
+		},
+	}
+	for name, test := range tests {
+		s := &server{pinger: test.pinger, sink: test.sink}
+		req := httptest.NewRequest("GET", "/readyz", nil)
+		rec := httptest.NewRecorder()
+		s.serveReadyz(rec, req)
+		if rec.Code != test.wantCode {
+			t.Errorf("%q: want status %d, got %d", name, test.wantCode, rec.Code)
+		}
+	}
+}
+
+func TestJSONError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	jsonError(rec, "boom", http.StatusNotFound)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("want status %d, got %d", http.StatusNotFound, rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("want Content-Type application/json, got %q", ct)
+	}
+	var body struct {
+		Msg string `json:"msg"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Msg != "boom" {
+		t.Errorf("want msg %q, got %q", "boom", body.Msg)
+	}
+}
@@ -10,12 +10,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"time"
 
 	"github.com/go-sql-driver/mysql"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
@@ -25,8 +27,6 @@ var (
 	errCertPEM        = errors.New("trusted conn with DB not established, cannot parse cert PEM")
 )
 
-// TODO: add TLS listener with default :8443
-
 func main() {
 	log.SetFlags(log.Llongfile | log.LUTC | log.LstdFlags)
 	log.SetPrefix("reqlogd: ")
@@ -46,18 +46,53 @@ func main() {
 		log.Fatal(err)
 	}
 
-	s := server{db: d, now: time.Now}
+	sink, err := sinksFromEnv(d)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	capture, err := bodyCaptureConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s := server{sink: sink, now: time.Now, capture: capture, logs: newLogStore(d), hub: newBroadcastHub(), pinger: d}
 	http.HandleFunc("/", s.serveReqLog)
+	http.HandleFunc("/logs", s.serveLogsList)
+	http.HandleFunc("/logs/stream", s.serveLogsStream)
+	http.HandleFunc("/logs/", s.serveLogsGet)
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/healthz", s.serveHealthz)
+	http.HandleFunc("/readyz", s.serveReadyz)
+
+	tlsConf, tlsEnabled, err := tlsListenerConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if tlsEnabled {
+		tlsSrv, err := newTLSServer(tlsConf, http.DefaultServeMux)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Printf("listening for TLS on %v", tlsConf.addr)
+			log.Fatal(tlsSrv.ListenAndServeTLS("", ""))
+		}()
+	}
 
 	log.Printf("listening on %v", addr)
 	http.ListenAndServe(addr, nil)
 }
 
 type server struct {
-	db interface {
-		ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	sink    Sink
+	now     func() time.Time
+	capture bodyCaptureConfig
+	logs    recordStore
+	hub     *broadcastHub
+	pinger  interface {
+		PingContext(ctx context.Context) error
 	}
-	now func() time.Time
 }
 
 func dbConfFromEnv() (*mysql.Config, error) {
@@ -82,22 +117,15 @@ func dbConfFromEnv() (*mysql.Config, error) {
 	if v, ok := os.LookupEnv("DB_NAME"); ok {
 		dconf.DBName = v
 	}
-	if _, ok := os.LookupEnv("DB_SKIP_TLS"); ok {
-		return dconf, nil
-	}
-	caCertPath, ok := os.LookupEnv("DB_CA_CERT_PATH")
-	if !ok {
-		return nil, errCertPath
-	}
-	clientCertPath, ok := os.LookupEnv("DB_CLIENT_CERT_PATH")
-	if !ok {
-		return nil, errClientCertPath
+
+	mode, err := dbTLSModeFromEnv()
+	if err != nil {
+		return nil, err
 	}
-	clientKeyPath, ok := os.LookupEnv("DB_CLIENT_KEY_PATH")
-	if !ok {
-		return nil, errClientKeyPath
+	if mode == dbTLSDisable {
+		return dconf, nil
 	}
-	tconf, err := tlsConfig(caCertPath, clientCertPath, clientKeyPath)
+	tconf, err := tlsConfig(mode, dconf.Addr)
 	if err != nil {
 		return nil, err
 	}
@@ -105,29 +133,114 @@ func dbConfFromEnv() (*mysql.Config, error) {
 	return dconf, nil
 }
 
-// tlsConfig calls mysql driver to enable TLS for mysql connection. tconfKey is
-// a key to retrieve the specific tls.Config created by tlsConfig.  It should
-// be used in the db connection string as the value of the tls param.  Use
-// caCertPath to specify the trusted certificates for the database. Use
-// clientCertPath and clientKeyPath to specify the client certificate and key
-// to be used for the db connection.
-func tlsConfig(caCertPath, clientCertPath, clientKeyPath string) (tconfKey string, err error) {
-	pem, err := ioutil.ReadFile(caCertPath)
-	if err != nil {
-		return "", err
+// dbTLSMode selects how reqlogd authenticates and verifies the TLS session
+// used for the MySQL connection.
+type dbTLSMode string
+
+const (
+	dbTLSDisable    dbTLSMode = "disable"
+	dbTLSSkipVerify dbTLSMode = "skip-verify"
+	dbTLSVerifyCA   dbTLSMode = "verify-ca"
+	dbTLSVerifyFull dbTLSMode = "verify-full"
+	dbTLSMutual     dbTLSMode = "mutual"
+)
+
+// dbTLSModeFromEnv reads DB_TLS_MODE. When it isn't set, it falls back to
+// the behavior implied by the legacy DB_SKIP_TLS/DB_CA_CERT_PATH/
+// DB_CLIENT_CERT_PATH/DB_CLIENT_KEY_PATH env vars, so existing deployments
+// keep working unchanged.
+func dbTLSModeFromEnv() (dbTLSMode, error) {
+	if v, ok := os.LookupEnv("DB_TLS_MODE"); ok {
+		switch dbTLSMode(v) {
+		case dbTLSDisable, dbTLSSkipVerify, dbTLSVerifyCA, dbTLSVerifyFull, dbTLSMutual:
+			return dbTLSMode(v), nil
+		default:
+			return "", fmt.Errorf("DB_TLS_MODE: unknown mode %q", v)
+		}
 	}
-	rootCertPool := x509.NewCertPool()
-	if ok := rootCertPool.AppendCertsFromPEM(pem); !ok {
-		return "", errCertPEM
+	if _, ok := os.LookupEnv("DB_SKIP_TLS"); ok {
+		return dbTLSDisable, nil
 	}
-	cert, err := tls.LoadX509KeyPair(clientCertPath, clientKeyPath)
-	if err != nil {
-		return "", err
+	if _, ok := os.LookupEnv("DB_CA_CERT_PATH"); !ok {
+		return "", errCertPath
+	}
+	if _, ok := os.LookupEnv("DB_CLIENT_CERT_PATH"); !ok {
+		return "", errClientCertPath
 	}
-	dbTLSConfig := &tls.Config{
-		RootCAs:      rootCertPool,
-		Certificates: []tls.Certificate{cert},
+	if _, ok := os.LookupEnv("DB_CLIENT_KEY_PATH"); !ok {
+		return "", errClientKeyPath
 	}
+	return dbTLSMutual, nil
+}
+
+// tlsConfig builds the *tls.Config for mode and registers it with the mysql
+// driver, returning tconfKey: the key to use as the tls param in the db
+// connection string. skip-verify needs no cert paths at all; verify-ca and
+// verify-full need DB_CA_CERT_PATH for the trusted root; mutual additionally
+// requires the client keypair from DB_CLIENT_CERT_PATH and
+// DB_CLIENT_KEY_PATH.
+//
+// verify-ca intentionally does not check the server's hostname, only that
+// its certificate chains to the trusted root. The standard library has no
+// direct way to express that: once RootCAs is set and InsecureSkipVerify is
+// false, go-sql-driver fills in ServerName from addr itself and the
+// handshake checks it. So verify-ca instead sets InsecureSkipVerify and
+// supplies its own VerifyPeerCertificate that walks the chain without a
+// hostname check, the pattern documented by go-sql-driver's README.
+// verify-full wants the hostname checked too, so it sets ServerName and
+// leaves the default verification in place.
+func tlsConfig(mode dbTLSMode, addr string) (tconfKey string, err error) {
+	dbTLSConfig := &tls.Config{}
+
+	var rootCertPool *x509.CertPool
+	if mode != dbTLSSkipVerify {
+		caCertPath, ok := os.LookupEnv("DB_CA_CERT_PATH")
+		if !ok {
+			return "", errCertPath
+		}
+		pem, err := ioutil.ReadFile(caCertPath)
+		if err != nil {
+			return "", err
+		}
+		rootCertPool = x509.NewCertPool()
+		if ok := rootCertPool.AppendCertsFromPEM(pem); !ok {
+			return "", errCertPEM
+		}
+	}
+
+	switch mode {
+	case dbTLSSkipVerify:
+		dbTLSConfig.InsecureSkipVerify = true
+	case dbTLSVerifyCA:
+		dbTLSConfig.InsecureSkipVerify = true
+		dbTLSConfig.VerifyPeerCertificate = verifyCertChain(rootCertPool)
+	case dbTLSVerifyFull:
+		dbTLSConfig.RootCAs = rootCertPool
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		dbTLSConfig.ServerName = host
+	case dbTLSMutual:
+		dbTLSConfig.RootCAs = rootCertPool
+	}
+
+	if mode == dbTLSMutual {
+		clientCertPath, ok := os.LookupEnv("DB_CLIENT_CERT_PATH")
+		if !ok {
+			return "", errClientCertPath
+		}
+		clientKeyPath, ok := os.LookupEnv("DB_CLIENT_KEY_PATH")
+		if !ok {
+			return "", errClientKeyPath
+		}
+		cert, err := tls.LoadX509KeyPair(clientCertPath, clientKeyPath)
+		if err != nil {
+			return "", err
+		}
+		dbTLSConfig.Certificates = []tls.Certificate{cert}
+	}
+
 	tconfKey = "custom"
 	if err := mysql.RegisterTLSConfig(tconfKey, dbTLSConfig); err != nil {
 		return "", err
@@ -135,6 +248,34 @@ func tlsConfig(caCertPath, clientCertPath, clientKeyPath string) (tconfKey strin
 	return tconfKey, nil
 }
 
+// verifyCertChain returns a tls.Config.VerifyPeerCertificate callback that
+// checks the peer's certificate chains to roots, without checking its
+// hostname the way the default verifier would.
+func verifyCertChain(roots *x509.CertPool) func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return fmt.Errorf("verifyCertChain: %v", err)
+			}
+			certs[i] = cert
+		}
+		if len(certs) == 0 {
+			return errors.New("verifyCertChain: server presented no certificates")
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+		})
+		return err
+	}
+}
+
 type db struct {
 	db *sql.DB
 }
@@ -154,20 +295,16 @@ func (d *db) ExecContext(ctx context.Context, query string, args ...interface{})
 	return d.db.ExecContext(ctx, query, args...)
 }
 
-/*
-CREATE TABLE `test`.`request` (
-  `id` BIGINT NOT NULL AUTO_INCREMENT,
-  `rat` DATETIME NOT NULL,
-  `url` TEXT NOT NULL,
-  `method` TEXT(16) NOT NULL,
-  `remote` TEXT(64) NOT NULL,
-  `headers` MEDIUMTEXT NULL,
-  `length` INT NOT NULL,
-  `protocol` TEXT(16) NOT NULL,
-  PRIMARY KEY (`id`));
-*/
+func (d *db) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return d.db.QueryContext(ctx, query, args...)
+}
+
+func (d *db) PingContext(ctx context.Context) error {
+	return d.db.PingContext(ctx)
+}
 
 func (s *server) serveReqLog(w http.ResponseWriter, r *http.Request) {
+	intakeTotal.Inc()
 	recievedAt := s.now().UTC()
 	var u url.URL
 	u = *r.URL
@@ -176,35 +313,88 @@ func (s *server) serveReqLog(w http.ResponseWriter, r *http.Request) {
 	if r.TLS != nil {
 		u.Scheme = "https"
 	}
-	url := u.String()
-	method := r.Method
-	remote := r.RemoteAddr
-	headers := fmt.Sprint(r.Header)
 	length := 0
+	var body []byte
+	var bodyTruncated bool
+	var bodySHA256 string
+	var bodyGzipped bool
 	if r.Body != nil {
-		b, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			log.Printf("serveReqLog: got error reading request body: %v", err)
+		if s.capture.enabled() && s.capture.allows(r.Header.Get("Content-Type")) {
+			captured, truncated, total, err := readCapturedBody(r.Body, s.capture.maxBytes)
+			if err != nil {
+				log.Printf("serveReqLog: got error reading request body: %v", err)
+			}
+			length = total
+			bodyTruncated = truncated
+			bodySHA256 = sha256Hex(captured)
+			body = captured
+			bodyCaptureBytesTotal.Add(float64(len(body)))
+			if int64(len(body)) >= s.capture.gzipThreshold {
+				gz, err := gzipBytes(body)
+				if err != nil {
+					log.Printf("serveReqLog: got error gzipping request body: %v", err)
+				} else {
+					body = gz
+					bodyGzipped = true
+				}
+			}
+		} else {
+			b, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				log.Printf("serveReqLog: got error reading request body: %v", err)
+			}
+			length = len(b)
+		}
+	}
+	tlsPeer := ""
+	var tlsPeerSANs []string
+	// VerifiedChains is only populated once Go's handshake has actually
+	// verified the peer cert against ClientCAs (ClientAuth
+	// RequireAndVerifyClientCert, or VerifyClientCertIfGiven when a cert was
+	// presented); under RequestClientCert/RequireAnyClientCert the cert is
+	// present but unverified, so treating it as an identity would let a
+	// caller spoof client_cn with a self-signed cert.
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cert := r.TLS.PeerCertificates[0]
+		tlsPeer = cert.Subject.CommonName
+		tlsPeerSANs = append(tlsPeerSANs, cert.DNSNames...)
+		for _, u := range cert.URIs {
+			tlsPeerSANs = append(tlsPeerSANs, u.String())
 		}
-		length = len(b)
 	}
-	protocol := r.Proto
 
-	_, err := s.db.ExecContext(r.Context(),
-		`insert into request (rat, url, method, remote, headers, length, protocol)
-		values (?, ?, ?, ?, ?, ?, ?)`,
-		recievedAt, url, method, remote, headers, length, protocol,
-	)
-	if err != nil {
-		log.Printf("serveReqLog: got error writing to DB: %v", err)
+	rec := &RequestRecord{
+		ReceivedAt:    recievedAt,
+		URL:           u.String(),
+		Method:        r.Method,
+		Remote:        r.RemoteAddr,
+		Headers:       map[string][]string(r.Header),
+		Length:        length,
+		Protocol:      r.Proto,
+		TLSPeer:       tlsPeer,
+		TLSPeerSANs:   tlsPeerSANs,
+		Body:          body,
+		BodyTruncated: bodyTruncated,
+		BodySHA256:    bodySHA256,
+		BodyGzipped:   bodyGzipped,
+	}
+
+	if err := s.sink.Write(r.Context(), rec); err != nil {
+		log.Printf("serveReqLog: got error writing to sink: %v", err)
 		jsonError(w, fmt.Sprintf("internal error: %v", err), 500)
 		return
 	}
+	if s.hub != nil {
+		s.hub.broadcast(rec)
+	}
 }
 
 func jsonError(w http.ResponseWriter, msg string, code int) {
-	if err := json.NewEncoder(w).Encode(struct{ msg string }{msg: msg}); err != nil {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(struct {
+		Msg string `json:"msg"`
+	}{Msg: msg}); err != nil {
 		log.Printf("jsonError: got error writing to client: %v", err)
 	}
-	w.WriteHeader(code)
 }
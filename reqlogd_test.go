@@ -2,80 +2,42 @@ package main
 
 import (
 	"context"
-	"database/sql"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
-type mockDB struct {
-	t  *testing.T
-	rr []*record
+// sliceSink is a Sink that appends every RequestRecord it's given to a
+// slice, so tests can inspect what the write path produced.
+type sliceSink struct {
+	mu sync.Mutex
+	rr []*RequestRecord
 }
 
-func newMockDB(t *testing.T) *mockDB {
-	return &mockDB{t: t}
+func (s *sliceSink) Write(ctx context.Context, r *RequestRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rr = append(s.rr, r)
+	return nil
 }
 
-func (md *mockDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
-	md.rr = append(md.rr, &record{
-		rat:      toTime(md.t, args[0]),
-		url:      toString(md.t, args[1]),
-		method:   toString(md.t, args[2]),
-		remote:   toString(md.t, args[3]),
-		headers:  toString(md.t, args[4]),
-		length:   toInt(md.t, args[5]),
-		protocol: toString(md.t, args[6]),
-	})
-	return nil, nil
-}
-
-func (md *mockDB) reset() {
-	md.rr = nil
-}
+func (s *sliceSink) Close() error { return nil }
 
-type record struct {
-	rat      time.Time
-	url      string
-	method   string
-	remote   string
-	headers  string
-	length   int
-	protocol string
-}
-
-func toTime(t *testing.T, v interface{}) time.Time {
-	tv, ok := v.(time.Time)
-	if !ok {
-		t.Fatalf("expected time value passed for field")
-	}
-	return tv
-}
-
-func toString(t *testing.T, v interface{}) string {
-	sv, ok := v.(string)
-	if !ok {
-		t.Fatalf("expected string value passed for field")
-	}
-	return sv
-}
-
-func toInt(t *testing.T, v interface{}) int {
-	iv, ok := v.(int)
-	if !ok {
-		t.Fatalf("expected int value passed for field")
-	}
-	return iv
+func (s *sliceSink) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rr = nil
 }
 
 func Test(t *testing.T) {
-	mockDB := newMockDB(t)
+	sink := &sliceSink{}
 	now := time.Now().UTC()
 	testServer := &server{
-		db:  mockDB,
-		now: func() time.Time { return now },
+		sink: sink,
+		now:  func() time.Time { return now },
 	}
 	ts := httptest.NewServer(http.HandlerFunc(testServer.serveReqLog))
 	defer ts.Close()
@@ -88,38 +50,40 @@ func Test(t *testing.T) {
 	tests := map[string]struct {
 		req         *http.Request
 		wantCode    int
-		wantRecords []*record
+		wantRecords []*RequestRecord
 	}{
 		"request record is inserted into database": {
 			req:      req,
 			wantCode: 200,
-			wantRecords: []*record{{
-				rat:      now,
-				url:      ts.URL + "/",
-				method:   "GET",
-				remote:   "127.0.0.1",
-				headers:  "map[User-Agent:[Go-http-client/1.1] Accept-Encoding:[gzip]]",
-				length:   0,
-				protocol: "HTTP/1.1",
+			wantRecords: []*RequestRecord{{
+				ReceivedAt: now,
+				URL:        ts.URL + "/",
+				Method:     "GET",
+				Remote:     "127.0.0.1",
+				Headers:    map[string][]string{"User-Agent": {"Go-http-client/1.1"}, "Accept-Encoding": {"gzip"}},
+				Length:     0,
+				Protocol:   "HTTP/1.1",
+				TLSPeer:    "",
 			}},
 		},
 		"request record is inserted into database again": {
 			req:      req,
 			wantCode: 200,
-			wantRecords: []*record{{
-				rat:      now,
-				url:      ts.URL + "/",
-				method:   "GET",
-				remote:   "127.0.0.1",
-				headers:  "map[User-Agent:[Go-http-client/1.1] Accept-Encoding:[gzip]]",
-				length:   0,
-				protocol: "HTTP/1.1",
+			wantRecords: []*RequestRecord{{
+				ReceivedAt: now,
+				URL:        ts.URL + "/",
+				Method:     "GET",
+				Remote:     "127.0.0.1",
+				Headers:    map[string][]string{"User-Agent": {"Go-http-client/1.1"}, "Accept-Encoding": {"gzip"}},
+				Length:     0,
+				Protocol:   "HTTP/1.1",
+				TLSPeer:    "",
 			}},
 		},
 	}
 
 	for name, test := range tests {
-		mockDB.reset()
+		sink.reset()
 		res, err := ts.Client().Do(test.req)
 		if err != nil {
 			t.Fatal(err)
@@ -127,33 +91,36 @@ func Test(t *testing.T) {
 		if res.StatusCode != test.wantCode {
 			t.Errorf("%q: want status code %v, got status code %v", name, test.wantCode, res.StatusCode)
 		}
-		if len(mockDB.rr) != len(test.wantRecords) {
-			t.Errorf("%q: expected one record in db, got %v", name, len(mockDB.rr))
+		if len(sink.rr) != len(test.wantRecords) {
+			t.Errorf("%q: expected one record in sink, got %v", name, len(sink.rr))
 			continue
 		}
-		for i := range mockDB.rr {
+		for i := range sink.rr {
 			wantr := test.wantRecords[i]
-			gotr := mockDB.rr[i]
-			if wantr.rat != gotr.rat {
-				t.Errorf("%q: at index %d expected record with rat %v, got %v", name, i, wantr.rat, gotr.rat)
+			gotr := sink.rr[i]
+			if wantr.ReceivedAt != gotr.ReceivedAt {
+				t.Errorf("%q: at index %d expected record with ReceivedAt %v, got %v", name, i, wantr.ReceivedAt, gotr.ReceivedAt)
+			}
+			if wantr.URL != gotr.URL {
+				t.Errorf("%q: at index %d expected record with URL %v, got %v", name, i, wantr.URL, gotr.URL)
 			}
-			if wantr.url != gotr.url {
-				t.Errorf("%q: at index %d expected record with url %v, got %v", name, i, wantr.url, gotr.url)
+			if wantr.Method != gotr.Method {
+				t.Errorf("%q: at index %d expected record with Method %v, got %v", name, i, wantr.Method, gotr.Method)
 			}
-			if wantr.method != gotr.method {
-				t.Errorf("%q: at index %d expected record with method %v, got %v", name, i, wantr.method, gotr.method)
+			if strings.Split(wantr.Remote, ":")[0] != strings.Split(gotr.Remote, ":")[0] {
+				t.Errorf("%q: at index %d expected record with Remote %v, got %v", name, i, wantr.Remote, gotr.Remote)
 			}
-			if strings.Split(wantr.remote, ":")[0] != strings.Split(gotr.remote, ":")[0] {
-				t.Errorf("%q: at index %d expected record with remote %v, got %v", name, i, wantr.remote, gotr.remote)
+			if len(wantr.Headers) != len(gotr.Headers) {
+				t.Errorf("%q: at index %d expected record with Headers %v, got %v", name, i, wantr.Headers, gotr.Headers)
 			}
-			if wantr.headers != gotr.headers {
-				t.Errorf("%q: at index %d expected record with headers %v, got %v", name, i, wantr.headers, gotr.headers)
+			if wantr.Length != gotr.Length {
+				t.Errorf("%q: at index %d expected record with Length %v, got %v", name, i, wantr.Length, gotr.Length)
 			}
-			if wantr.length != gotr.length {
-				t.Errorf("%q: at index %d expected record with length %v, got %v", name, i, wantr.length, gotr.length)
+			if wantr.Protocol != gotr.Protocol {
+				t.Errorf("%q: at index %d expected record with Protocol %v, got %v", name, i, wantr.Protocol, gotr.Protocol)
 			}
-			if wantr.protocol != gotr.protocol {
-				t.Errorf("%q: at index %d expected record with protocol %v, got %v", name, i, wantr.protocol, gotr.protocol)
+			if wantr.TLSPeer != gotr.TLSPeer {
+				t.Errorf("%q: at index %d expected record with TLSPeer %v, got %v", name, i, wantr.TLSPeer, gotr.TLSPeer)
 			}
 		}
 	}
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// RequestRecord is the strongly-typed representation of a single logged
+// HTTP request, handed to the sink layer by serveReqLog.
+type RequestRecord struct {
+	ReceivedAt time.Time
+	URL        string
+	Method     string
+	Remote     string
+	Headers    map[string][]string
+	Length     int
+	Protocol   string
+
+	// TLSPeer and TLSPeerSANs are only populated once the client's cert has
+	// actually been verified against REQLOGD_TLS_CLIENT_CA; an unverified
+	// cert (ClientAuth modes that merely request one) leaves both zero so a
+	// caller can't spoof client_cn with a self-signed cert.
+	TLSPeer     string
+	TLSPeerSANs []string
+
+	// Body, BodyTruncated, BodySHA256, and BodyGzipped are only populated
+	// when body capture is enabled via REQLOGD_CAPTURE_BODY_MAX_BYTES.
+	// BodySHA256 is computed over the captured bytes before any gzip
+	// compression, so it identifies the content for dedup regardless of
+	// how it ends up stored; BodyGzipped reports whether Body itself is
+	// gzip-compressed (see bodyCaptureConfig.gzipThreshold), so a reader
+	// knows to decompress it before comparing against BodySHA256.
+	Body          []byte
+	BodyTruncated bool
+	BodySHA256    string
+	BodyGzipped   bool
+}
+
+// Sink delivers RequestRecords somewhere: MySQL, a file, a message queue...
+type Sink interface {
+	Write(ctx context.Context, r *RequestRecord) error
+	Close() error
+}
+
+// MultiSink fans each RequestRecord out to every sink in the slice, so the
+// write path can feed several destinations without serveReqLog knowing
+// about any of them.
+type MultiSink []Sink
+
+func (m MultiSink) Write(ctx context.Context, r *RequestRecord) error {
+	var errs []string
+	for _, s := range m {
+		if err := s.Write(ctx, r); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("MultiSink Write: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (m MultiSink) Close() error {
+	var errs []string
+	for _, s := range m {
+		if err := s.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("MultiSink Close: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+var errSinkQueueFull = errors.New("asyncSink: queue is full, record dropped")
+
+// BatchSink is implemented by sinks that can persist several records in one
+// operation. asyncSink uses it when the wrapped sink supports it, so a burst
+// of writes costs one round trip instead of one per record; sinks that don't
+// implement it fall back to asyncSink's one-at-a-time delivery.
+type BatchSink interface {
+	WriteBatch(ctx context.Context, rs []*RequestRecord) error
+}
+
+// asyncSink decouples a slow sink from the request path: Write enqueues the
+// record and returns immediately, while a background goroutine delivers
+// records to the wrapped sink. When the sink implements BatchSink, records
+// are accumulated and flushed together once batchSize records are queued or
+// batchMaxWait elapses, whichever comes first; otherwise they're delivered
+// one at a time. The queue is bounded; once full, Write drops the record
+// rather than blocking the caller and counts the drop as backpressure via
+// sinkWriteErrorsTotal{class="queue_full"}.
+type asyncSink struct {
+	sink         Sink
+	queue        chan *RequestRecord
+	done         chan struct{}
+	name         string
+	batchSize    int
+	batchMaxWait time.Duration
+}
+
+func newAsyncSink(sink Sink, queueSize, batchSize int, batchMaxWait time.Duration) *asyncSink {
+	a := &asyncSink{
+		sink:         sink,
+		queue:        make(chan *RequestRecord, queueSize),
+		done:         make(chan struct{}),
+		name:         fmt.Sprintf("%T", sink),
+		batchSize:    batchSize,
+		batchMaxWait: batchMaxWait,
+	}
+	go a.run()
+	go a.reportQueueDepth()
+	return a
+}
+
+func (a *asyncSink) run() {
+	defer close(a.done)
+	if b, ok := a.sink.(BatchSink); ok {
+		a.runBatched(b)
+		return
+	}
+	for r := range a.queue {
+		a.writeOne(r)
+	}
+}
+
+// writeOne delivers a single record to the wrapped sink on the one-at-a-time
+// path, recording its latency and any error by class; runBatched's flush
+// records the same metrics for a whole batch.
+func (a *asyncSink) writeOne(r *RequestRecord) {
+	start := time.Now()
+	err := a.sink.Write(context.Background(), r)
+	sinkWriteDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		sinkWriteErrorsTotal.WithLabelValues(errClass(err)).Inc()
+		log.Printf("asyncSink: got error writing to %T: %v", a.sink, err)
+	}
+}
+
+// runBatched accumulates queued records into buf and flushes them to b via a
+// single WriteBatch call once buf reaches a.batchSize or a.batchMaxWait has
+// passed since the last flush, whichever comes first. It flushes whatever's
+// left in buf when the queue is closed.
+func (a *asyncSink) runBatched(b BatchSink) {
+	ticker := time.NewTicker(a.batchMaxWait)
+	defer ticker.Stop()
+	buf := make([]*RequestRecord, 0, a.batchSize)
+	flush := func() {
+		if len(buf) == 0 {
+			return
+		}
+		start := time.Now()
+		err := b.WriteBatch(context.Background(), buf)
+		sinkWriteDuration.Observe(time.Since(start).Seconds())
+		if err != nil {
+			sinkWriteErrorsTotal.WithLabelValues(errClass(err)).Add(float64(len(buf)))
+			log.Printf("asyncSink: got error batch writing %d records to %T: %v", len(buf), a.sink, err)
+		}
+		buf = buf[:0]
+		ticker.Reset(a.batchMaxWait)
+	}
+	for {
+		select {
+		case r, ok := <-a.queue:
+			if !ok {
+				flush()
+				return
+			}
+			buf = append(buf, r)
+			if len(buf) >= a.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (a *asyncSink) reportQueueDepth() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.done:
+			sinkQueueDepth.DeleteLabelValues(a.name)
+			return
+		case <-ticker.C:
+			sinkQueueDepth.WithLabelValues(a.name).Set(float64(a.queueDepth()))
+		}
+	}
+}
+
+// queueStats implements queueStatter for /readyz.
+func (a *asyncSink) queueStats() (depth, capacity int) {
+	return len(a.queue), cap(a.queue)
+}
+
+func (a *asyncSink) Write(ctx context.Context, r *RequestRecord) error {
+	select {
+	case a.queue <- r:
+		return nil
+	default:
+		sinkWriteErrorsTotal.WithLabelValues("queue_full").Inc()
+		return errSinkQueueFull
+	}
+}
+
+// queueDepth reports how many records are currently queued, for the
+// sinkQueueDepth gauge.
+func (a *asyncSink) queueDepth() int {
+	return len(a.queue)
+}
+
+func (a *asyncSink) Close() error {
+	close(a.queue)
+	<-a.done
+	return a.sink.Close()
+}
+
+/*
+CREATE TABLE `test`.`request` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT,
+  `rat` DATETIME NOT NULL,
+  `url` TEXT NOT NULL,
+  `method` TEXT(16) NOT NULL,
+  `remote` TEXT(64) NOT NULL,
+  `headers` JSON NULL,
+  `length` INT NOT NULL,
+  `protocol` TEXT(16) NOT NULL,
+  `client_cn` TEXT(256) NULL,
+  `client_san` JSON NULL,
+  `body` MEDIUMBLOB NULL,
+  `body_truncated` BOOLEAN NOT NULL DEFAULT FALSE,
+  `body_sha256` CHAR(64) NULL,
+  `body_gzipped` BOOLEAN NOT NULL DEFAULT FALSE,
+  PRIMARY KEY (`id`),
+  KEY `rat_id_idx` (`rat`, `id`));
+*/
+
+// mysqlInsertColumns lists the request table columns written by both
+// mysqlSink.Write and mysqlSink.WriteBatch, in placeholder order.
+const mysqlInsertColumns = "rat, url, method, remote, headers, length, protocol, client_cn, client_san, body, body_truncated, body_sha256, body_gzipped"
+
+// mysqlSink writes RequestRecords to the request table via db, the
+// existing ExecContext-shaped MySQL handle.
+type mysqlSink struct {
+	db interface {
+		ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	}
+}
+
+func (s *mysqlSink) Write(ctx context.Context, r *RequestRecord) error {
+	headers, clientSAN, err := r.marshaledForInsert()
+	if err != nil {
+		return fmt.Errorf("mysqlSink Write: %v", err)
+	}
+	_, err = s.db.ExecContext(ctx,
+		`insert into request (`+mysqlInsertColumns+`)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.ReceivedAt, r.URL, r.Method, r.Remote, headers, r.Length, r.Protocol, nullableString(r.TLSPeer), clientSAN,
+		r.Body, r.BodyTruncated, nullableString(r.BodySHA256), r.BodyGzipped,
+	)
+	return err
+}
+
+// WriteBatch inserts rs in a single multi-row INSERT, so a burst of queued
+// records costs one round trip to MySQL instead of one per record.
+func (s *mysqlSink) WriteBatch(ctx context.Context, rs []*RequestRecord) error {
+	if len(rs) == 0 {
+		return nil
+	}
+	var q strings.Builder
+	fmt.Fprintf(&q, "insert into request (%s) values ", mysqlInsertColumns)
+	args := make([]interface{}, 0, len(rs)*13)
+	for i, r := range rs {
+		if i > 0 {
+			q.WriteString(", ")
+		}
+		q.WriteString("(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+		headers, clientSAN, err := r.marshaledForInsert()
+		if err != nil {
+			return fmt.Errorf("mysqlSink WriteBatch: %v", err)
+		}
+		args = append(args, r.ReceivedAt, r.URL, r.Method, r.Remote, headers, r.Length, r.Protocol,
+			nullableString(r.TLSPeer), clientSAN, r.Body, r.BodyTruncated, nullableString(r.BodySHA256), r.BodyGzipped)
+	}
+	_, err := s.db.ExecContext(ctx, q.String(), args...)
+	return err
+}
+
+func (s *mysqlSink) Close() error { return nil }
+
+// marshaledForInsert JSON-encodes r.Headers and r.TLSPeerSANs for the
+// headers and client_san columns.
+func (r *RequestRecord) marshaledForInsert() (headers string, clientSAN interface{}, err error) {
+	h, err := json.Marshal(r.Headers)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(r.TLSPeerSANs) == 0 {
+		return string(h), nil, nil
+	}
+	san, err := json.Marshal(r.TLSPeerSANs)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(h), string(san), nil
+}
+
+// nullableString maps the empty string to nil so optional text columns
+// store SQL NULL instead of an empty string.
+func nullableString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// stdoutSink writes each RequestRecord as a line of JSON to stdout, mainly
+// useful for local development.
+type stdoutSink struct{}
+
+func (stdoutSink) Write(ctx context.Context, r *RequestRecord) error {
+	return json.NewEncoder(os.Stdout).Encode(r)
+}
+
+func (stdoutSink) Close() error { return nil }
+
+// fileSink appends each RequestRecord as a line of JSON to a file, rotating
+// to a new file once the current one passes maxBytes or maxAge.
+type fileSink struct {
+	dir      string
+	prefix   string
+	maxBytes int64
+	maxAge   time.Duration
+
+	mu       sync.Mutex
+	f        *os.File
+	w        *bufio.Writer
+	size     int64
+	openedAt time.Time
+}
+
+func newFileSink(dir, prefix string, maxBytes int64, maxAge time.Duration) (*fileSink, error) {
+	fs := &fileSink{dir: dir, prefix: prefix, maxBytes: maxBytes, maxAge: maxAge}
+	if err := fs.rotate(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+func (fs *fileSink) rotate() error {
+	if fs.f != nil {
+		if err := fs.flushAndClose(); err != nil {
+			return err
+		}
+	}
+	name := filepath.Join(fs.dir, fmt.Sprintf("%s-%d.jsonl", fs.prefix, time.Now().UnixNano()))
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("fileSink rotate: %v", err)
+	}
+	fs.f = f
+	fs.w = bufio.NewWriter(f)
+	fs.size = 0
+	fs.openedAt = time.Now()
+	return nil
+}
+
+func (fs *fileSink) flushAndClose() error {
+	if err := fs.w.Flush(); err != nil {
+		return err
+	}
+	return fs.f.Close()
+}
+
+func (fs *fileSink) Write(ctx context.Context, r *RequestRecord) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.size >= fs.maxBytes || (fs.maxAge > 0 && time.Since(fs.openedAt) >= fs.maxAge) {
+		if err := fs.rotate(); err != nil {
+			return err
+		}
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("fileSink Write: %v", err)
+	}
+	b = append(b, '\n')
+	n, err := fs.w.Write(b)
+	if err != nil {
+		return fmt.Errorf("fileSink Write: %v", err)
+	}
+	fs.size += int64(n)
+	return fs.w.Flush()
+}
+
+func (fs *fileSink) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.flushAndClose()
+}
+
+// kafkaSink publishes each RequestRecord as a JSON message to a Kafka topic.
+type kafkaSink struct {
+	w *kafka.Writer
+}
+
+func newKafkaSink(brokers []string, topic string) *kafkaSink {
+	return &kafkaSink{w: &kafka.Writer{
+		Addr:     kafka.TCP(brokers...),
+		Topic:    topic,
+		Balancer: &kafka.LeastBytes{},
+	}}
+}
+
+func (s *kafkaSink) Write(ctx context.Context, r *RequestRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("kafkaSink Write: %v", err)
+	}
+	return s.w.WriteMessages(ctx, kafka.Message{Value: b})
+}
+
+// WriteBatch publishes rs as a single batch of Kafka messages, so a burst of
+// queued records costs one produce request instead of one per record.
+func (s *kafkaSink) WriteBatch(ctx context.Context, rs []*RequestRecord) error {
+	msgs := make([]kafka.Message, len(rs))
+	for i, r := range rs {
+		b, err := json.Marshal(r)
+		if err != nil {
+			return fmt.Errorf("kafkaSink WriteBatch: %v", err)
+		}
+		msgs[i] = kafka.Message{Value: b}
+	}
+	return s.w.WriteMessages(ctx, msgs...)
+}
+
+func (s *kafkaSink) Close() error {
+	return s.w.Close()
+}
+
+const (
+	defaultSinkQueueSize    = 1024
+	defaultSinkBatchSize    = 100
+	defaultSinkBatchMaxWait = 200 * time.Millisecond
+)
+
+// sinksFromEnv builds the Sink configured by REQLOGD_SINKS, a
+// comma-separated list drawn from mysql, stdout, file, kafka. It defaults
+// to mysql alone, so existing deployments keep writing to the same place.
+// db is only required when mysql is selected.
+func sinksFromEnv(db interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}) (Sink, error) {
+	names := []string{"mysql"}
+	if v, ok := os.LookupEnv("REQLOGD_SINKS"); ok {
+		names = strings.Split(v, ",")
+	}
+
+	queueSize := defaultSinkQueueSize
+	if v, ok := os.LookupEnv("REQLOGD_SINK_QUEUE_SIZE"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("REQLOGD_SINK_QUEUE_SIZE: %v", err)
+		}
+		queueSize = n
+	}
+
+	batchSize := defaultSinkBatchSize
+	if v, ok := os.LookupEnv("REQLOGD_SINK_BATCH_SIZE"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("REQLOGD_SINK_BATCH_SIZE: %v", err)
+		}
+		if n <= 0 {
+			return nil, fmt.Errorf("REQLOGD_SINK_BATCH_SIZE: must be positive, got %d", n)
+		}
+		batchSize = n
+	}
+
+	batchMaxWait := defaultSinkBatchMaxWait
+	if v, ok := os.LookupEnv("REQLOGD_SINK_BATCH_MAX_WAIT"); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("REQLOGD_SINK_BATCH_MAX_WAIT: %v", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("REQLOGD_SINK_BATCH_MAX_WAIT: must be positive, got %s", d)
+		}
+		batchMaxWait = d
+	}
+
+	var multi MultiSink
+	for _, name := range names {
+		switch strings.TrimSpace(name) {
+		case "mysql":
+			if db == nil {
+				return nil, errors.New("sinksFromEnv: mysql sink requires a db connection")
+			}
+			multi = append(multi, newAsyncSink(&mysqlSink{db: db}, queueSize, batchSize, batchMaxWait))
+		case "stdout":
+			multi = append(multi, stdoutSink{})
+		case "file":
+			dir := os.Getenv("REQLOGD_FILE_SINK_DIR")
+			if dir == "" {
+				dir = "."
+			}
+			maxBytes := int64(100 << 20) // 100MiB
+			if v, ok := os.LookupEnv("REQLOGD_FILE_SINK_MAX_BYTES"); ok {
+				n, err := strconv.ParseInt(v, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("REQLOGD_FILE_SINK_MAX_BYTES: %v", err)
+				}
+				maxBytes = n
+			}
+			var maxAge time.Duration
+			if v, ok := os.LookupEnv("REQLOGD_FILE_SINK_MAX_AGE"); ok {
+				d, err := time.ParseDuration(v)
+				if err != nil {
+					return nil, fmt.Errorf("REQLOGD_FILE_SINK_MAX_AGE: %v", err)
+				}
+				maxAge = d
+			}
+			fs, err := newFileSink(dir, "reqlog", maxBytes, maxAge)
+			if err != nil {
+				return nil, err
+			}
+			multi = append(multi, newAsyncSink(fs, queueSize, batchSize, batchMaxWait))
+		case "kafka":
+			brokers, ok := os.LookupEnv("REQLOGD_KAFKA_BROKERS")
+			if !ok {
+				return nil, errors.New("REQLOGD_KAFKA_BROKERS is required for the kafka sink")
+			}
+			topic, ok := os.LookupEnv("REQLOGD_KAFKA_TOPIC")
+			if !ok {
+				return nil, errors.New("REQLOGD_KAFKA_TOPIC is required for the kafka sink")
+			}
+			multi = append(multi, newAsyncSink(newKafkaSink(strings.Split(brokers, ","), topic), queueSize, batchSize, batchMaxWait))
+		default:
+			return nil, fmt.Errorf("REQLOGD_SINKS: unknown sink %q", name)
+		}
+	}
+	if len(multi) == 1 {
+		return multi[0], nil
+	}
+	return multi, nil
+}
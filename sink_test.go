@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sliceBatchSink is a BatchSink that appends each WriteBatch call's records
+// as one batch, so tests can inspect how asyncSink grouped them.
+type sliceBatchSink struct {
+	mu      sync.Mutex
+	batches [][]*RequestRecord
+}
+
+func (s *sliceBatchSink) Write(ctx context.Context, r *RequestRecord) error {
+	return s.WriteBatch(ctx, []*RequestRecord{r})
+}
+
+func (s *sliceBatchSink) WriteBatch(ctx context.Context, rs []*RequestRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	batch := make([]*RequestRecord, len(rs))
+	copy(batch, rs)
+	s.batches = append(s.batches, batch)
+	return nil
+}
+
+func (s *sliceBatchSink) Close() error { return nil }
+
+func (s *sliceBatchSink) snapshot() [][]*RequestRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]*RequestRecord(nil), s.batches...)
+}
+
+// waitForBatches polls snapshot until it has at least n batches or timeout
+// elapses, since asyncSink delivers on a background goroutine.
+func waitForBatches(t *testing.T, sink *sliceBatchSink, n int, timeout time.Duration) [][]*RequestRecord {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		got := sink.snapshot()
+		if len(got) >= n || time.Now().After(deadline) {
+			return got
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAsyncSinkBatchesBySize(t *testing.T) {
+	sink := &sliceBatchSink{}
+	a := newAsyncSink(sink, 10, 2, time.Hour)
+	defer a.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := a.Write(context.Background(), &RequestRecord{URL: "/"}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	batches := waitForBatches(t, sink, 1, time.Second)
+	if len(batches) != 1 {
+		t.Fatalf("got %d batches, want 1", len(batches))
+	}
+	if len(batches[0]) != 2 {
+		t.Errorf("got batch of %d records, want 2", len(batches[0]))
+	}
+}
+
+func TestAsyncSinkBatchesByMaxWait(t *testing.T) {
+	sink := &sliceBatchSink{}
+	a := newAsyncSink(sink, 10, 100, 10*time.Millisecond)
+	defer a.Close()
+
+	if err := a.Write(context.Background(), &RequestRecord{URL: "/"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	batches := waitForBatches(t, sink, 1, time.Second)
+	if len(batches) != 1 {
+		t.Fatalf("got %d batches, want 1", len(batches))
+	}
+	if len(batches[0]) != 1 {
+		t.Errorf("got batch of %d records, want 1", len(batches[0]))
+	}
+}
+
+func TestAsyncSinkFallsBackWithoutBatchSink(t *testing.T) {
+	sink := &sliceSink{}
+	a := newAsyncSink(sink, 10, 100, time.Hour)
+	defer a.Close()
+
+	if err := a.Write(context.Background(), &RequestRecord{URL: "/"}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		sink.mu.Lock()
+		n := len(sink.rr)
+		sink.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d records written, want 1", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+var errClientCAPath = errors.New("REQLOGD_TLS_CLIENT_CA is required when REQLOGD_TLS_CLIENT_AUTH verifies client certificates")
+
+// tlsListenerConfig holds the settings needed to run the HTTPS listener
+// alongside the plaintext one.
+type tlsListenerConfig struct {
+	addr       string
+	certPath   string
+	keyPath    string
+	clientCA   string
+	clientAuth tls.ClientAuthType
+}
+
+// tlsListenerConfigFromEnv reads the REQLOGD_TLS_* env vars. The second
+// return value reports whether the TLS listener is enabled at all: it is
+// off unless REQLOGD_TLS_ADDR is set.
+func tlsListenerConfigFromEnv() (*tlsListenerConfig, bool, error) {
+	addr, ok := os.LookupEnv("REQLOGD_TLS_ADDR")
+	if !ok {
+		return nil, false, nil
+	}
+	certPath, ok := os.LookupEnv("REQLOGD_TLS_CERT")
+	if !ok {
+		return nil, false, errors.New("REQLOGD_TLS_CERT is required when REQLOGD_TLS_ADDR is set")
+	}
+	keyPath, ok := os.LookupEnv("REQLOGD_TLS_KEY")
+	if !ok {
+		return nil, false, errors.New("REQLOGD_TLS_KEY is required when REQLOGD_TLS_ADDR is set")
+	}
+	clientAuth := tls.NoClientCert
+	if v, ok := os.LookupEnv("REQLOGD_TLS_CLIENT_AUTH"); ok {
+		ca, err := parseClientAuthType(v)
+		if err != nil {
+			return nil, false, err
+		}
+		clientAuth = ca
+	}
+	clientCA := os.Getenv("REQLOGD_TLS_CLIENT_CA")
+	if clientCA == "" && clientAuth >= tls.VerifyClientCertIfGiven {
+		return nil, false, errClientCAPath
+	}
+	return &tlsListenerConfig{
+		addr:       addr,
+		certPath:   certPath,
+		keyPath:    keyPath,
+		clientCA:   clientCA,
+		clientAuth: clientAuth,
+	}, true, nil
+}
+
+func parseClientAuthType(v string) (tls.ClientAuthType, error) {
+	switch v {
+	case "none":
+		return tls.NoClientCert, nil
+	case "request":
+		return tls.RequestClientCert, nil
+	case "require-any":
+		return tls.RequireAnyClientCert, nil
+	case "verify-if-given":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require-and-verify":
+		return tls.RequireAndVerifyClientCert, nil
+	default:
+		return 0, fmt.Errorf("REQLOGD_TLS_CLIENT_AUTH: unknown mode %q", v)
+	}
+}
+
+// certReloader serves the server certificate/key pair used by the TLS
+// listener and can reload it from disk at runtime, so operators can rotate
+// it without restarting reqlogd.
+type certReloader struct {
+	certPath, keyPath string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newCertReloader(certPath, keyPath string) (*certReloader, error) {
+	cr := &certReloader{certPath: certPath, keyPath: keyPath}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(cr.certPath, cr.keyPath)
+	if err != nil {
+		return fmt.Errorf("certReloader reload: %v", err)
+	}
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.mu.Unlock()
+	return nil
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// clientCAReloader serves the pool of CAs trusted to verify client
+// certificates and can reload it from disk at runtime. base is the rest of
+// the listener's tls.Config (GetCertificate, ClientAuth, ...): crypto/tls
+// replaces the whole config with whatever GetConfigForClient returns rather
+// than merging it, so every call must return a clone of base with only
+// ClientCAs swapped in — never a bare &tls.Config{ClientCAs: ...}, which
+// would silently drop the server certificate and downgrade ClientAuth back
+// to NoClientCert.
+type clientCAReloader struct {
+	path string
+	base *tls.Config
+
+	mu   sync.RWMutex
+	pool *x509.CertPool
+}
+
+// newClientCAReloader returns nil, nil when path is empty: client cert
+// verification is then left to whatever ClientCAs the caller sets directly.
+func newClientCAReloader(path string, base *tls.Config) (*clientCAReloader, error) {
+	if path == "" {
+		return nil, nil
+	}
+	cr := &clientCAReloader{path: path, base: base}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *clientCAReloader) reload() error {
+	pem, err := ioutil.ReadFile(cr.path)
+	if err != nil {
+		return fmt.Errorf("clientCAReloader reload: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if ok := pool.AppendCertsFromPEM(pem); !ok {
+		return errCertPEM
+	}
+	cr.mu.Lock()
+	cr.pool = pool
+	cr.mu.Unlock()
+	return nil
+}
+
+func (cr *clientCAReloader) GetConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	conf := cr.base.Clone()
+	conf.ClientCAs = cr.pool
+	return conf, nil
+}
+
+// newTLSServer builds the HTTPS listener described by conf, wired up to
+// reload its server certificate and client CA pool on SIGHUP so operators
+// can rotate certificates without restarting reqlogd.
+func newTLSServer(conf *tlsListenerConfig, handler http.Handler) (*http.Server, error) {
+	certs, err := newCertReloader(conf.certPath, conf.keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	tconf := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		ClientAuth:     conf.clientAuth,
+	}
+
+	cas, err := newClientCAReloader(conf.clientCA, tconf)
+	if err != nil {
+		return nil, err
+	}
+	if cas != nil {
+		tconf.GetConfigForClient = cas.GetConfigForClient
+	}
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			log.Println("received SIGHUP, reloading TLS certificates")
+			if err := certs.reload(); err != nil {
+				log.Printf("newTLSServer: %v", err)
+			}
+			if cas != nil {
+				if err := cas.reload(); err != nil {
+					log.Printf("newTLSServer: %v", err)
+				}
+			}
+		}
+	}()
+
+	return &http.Server{
+		Addr:      conf.addr,
+		Handler:   handler,
+		TLSConfig: tconf,
+	}, nil
+}